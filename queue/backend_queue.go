@@ -0,0 +1,12 @@
+package queue
+
+// BackendQueue 表示一个可持久化的数据队列，FtSender 使用它在发送失败时暂存数据，
+// 并在恢复之后重新读取发送。磁盘队列、内存队列等具体实现都需要满足该接口。
+type BackendQueue interface {
+	Put([]byte) error
+	ReadChan() <-chan []byte
+	Close() error
+	Delete() error
+	Depth() int64
+	Name() string
+}
@@ -0,0 +1,15 @@
+//go:build linux
+// +build linux
+
+package queue
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFileDirectIO 在 Linux 上以 O_DIRECT 打开 segment 文件，绕过页缓存直接
+// 写盘。调用方负责把写缓冲对齐到 directIOAlignment，否则内核会拒绝写入。
+func openFileDirectIO(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|syscall.O_DIRECT, 0600)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package queue
+
+import "os"
+
+// openFileDirectIO 在非 Linux 平台上没有 O_DIRECT，退化为普通的 buffered IO 打开，
+// 写缓冲仍然会按 directIOAlignment 对齐，只是不再绕过页缓存。
+func openFileDirectIO(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+}
@@ -0,0 +1,183 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/qiniu/log"
+)
+
+// maxLegacyRecordBytes 是迁移时对单条记录长度的合理性上限，用于在遇到损坏的
+// 长度前缀（例如读到了记录中间的数据）时尽早报错，而不是误当成一个超大的
+// length 去申请内存
+const maxLegacyRecordBytes = 1 << 30 // 1GB
+
+// legacyMeta 对应旧版 queue.DiskQueue（兼容 NSQ diskqueue 设计）的 meta 文件内容：
+// 第一行是 depth，第二行是 "readFileNum,readPos"，第三行是 "writeFileNum,writePos"。
+// readFileNum/readPos 是旧版已经确认消费过的位置之后第一个尚未投递的字节，
+// 迁移必须从这里开始，否则会把已经处理过的消息重新注入一遍。
+type legacyMeta struct {
+	depth        int64
+	readFileNum  int64
+	readPos      int64
+	writeFileNum int64
+	writePos     int64
+}
+
+func legacyMetaFileName(legacyDataPath, name string) string {
+	return filepath.Join(legacyDataPath, fmt.Sprintf("%s.diskqueue.meta.dat", name))
+}
+
+func legacyFileName(legacyDataPath, name string, fileNum int64) string {
+	return filepath.Join(legacyDataPath, fmt.Sprintf("%s.diskqueue.%06d.dat", name, fileNum))
+}
+
+// migratedMarkerFileName 迁移成功后落盘的一次性标记文件。它的存在表示 name 对应
+// 的旧版数据已经完整迁移进了 v2 队列，下次启动直接跳过，不会把同一批数据
+// 重复注入一遍。
+func migratedMarkerFileName(legacyDataPath, name string) string {
+	return filepath.Join(legacyDataPath, fmt.Sprintf("%s.diskqueue.migrated", name))
+}
+
+func readLegacyMeta(legacyDataPath, name string) (*legacyMeta, error) {
+	f, err := os.Open(legacyMetaFileName(legacyDataPath, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var m legacyMeta
+	if _, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n", &m.depth, &m.readFileNum, &m.readPos, &m.writeFileNum, &m.writePos); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// MigrateLegacyQueue 用于从旧版磁盘队列文件中读取数据，并逐条写入新的 v2 队列。
+// 旧版队列（queue.DiskQueue）里每条记录前有一个 4 字节大端长度前缀，紧跟着
+// 对应长度的 payload，记录首尾相接写满一个 segment 文件，没有 CRC 校验。
+//
+// 迁移从 legacy meta 记录的 readFileNum/readPos 开始，一直读到 writeFileNum 对应
+// 文件的末尾（不按 writePos 截断），跳过旧版已经投递过的消息；处理完所有文件后
+// 会写一个标记文件，之后的调用直接跳过，保证迁移是一次性操作。单个文件中途
+// 出错只记录日志，该文件剩余的记录不再迁移，也不会阻止标记文件的写入。如果 meta 文件不
+// 存在（例如从未被旧版真正打开过），退化为按文件名顺序全量迁移所有匹配
+// "<name>.diskqueue.NNNNNN.dat" 的 segment 文件。
+func MigrateLegacyQueue(legacyDataPath, name string, dest BackendQueue) (migrated int, err error) {
+	markerFile := migratedMarkerFileName(legacyDataPath, name)
+	if _, statErr := os.Stat(markerFile); statErr == nil {
+		return 0, nil
+	}
+
+	meta, metaErr := readLegacyMeta(legacyDataPath, name)
+	if metaErr != nil {
+		if !os.IsNotExist(metaErr) {
+			log.Errorf("MigrateLegacyQueue(%s): failed to read legacy meta, falling back to migrating every segment from offset 0: %v", name, metaErr)
+		}
+		migrated, err = migrateAllLegacyFiles(legacyDataPath, name, dest)
+	} else {
+		migrated, err = migrateFromLegacyMeta(legacyDataPath, name, meta, dest)
+	}
+	if err != nil {
+		return migrated, err
+	}
+
+	if werr := ioutil.WriteFile(markerFile, []byte("migrated\n"), 0600); werr != nil {
+		log.Errorf("MigrateLegacyQueue(%s): failed to write migration marker, may re-migrate on next restart: %v", name, werr)
+	}
+	return migrated, nil
+}
+
+// migrateFromLegacyMeta 按 legacy meta 记录的读写边界迁移，只处理 readFileNum 里
+// readPos 之后的部分，到 writeFileNum 为止（晚于 writePos 的内容还不存在）。
+func migrateFromLegacyMeta(legacyDataPath, name string, meta *legacyMeta, dest BackendQueue) (migrated int, err error) {
+	for fileNum := meta.readFileNum; fileNum <= meta.writeFileNum; fileNum++ {
+		startOffset := int64(0)
+		if fileNum == meta.readFileNum {
+			startOffset = meta.readPos
+		}
+		fileName := legacyFileName(legacyDataPath, name, fileNum)
+		n, ferr := migrateLegacyFile(fileName, startOffset, dest)
+		migrated += n
+		if ferr != nil {
+			log.Errorf("MigrateLegacyQueue(%s): failed to fully migrate %s: %v", name, fileName, ferr)
+		}
+	}
+	return migrated, nil
+}
+
+// migrateAllLegacyFiles 在没有 legacy meta（或读取失败）时的兜底路径：按文件名
+// 顺序迁移所有匹配的 segment 文件，从每个文件开头读取。只在 meta 缺失时使用，
+// 因为这种情况下无法知道哪些消息已经被旧版消费过。
+func migrateAllLegacyFiles(legacyDataPath, name string, dest BackendQueue) (migrated int, err error) {
+	pattern := filepath.Join(legacyDataPath, fmt.Sprintf("%s.diskqueue.??????.dat", name))
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(files)
+
+	for _, fileName := range files {
+		n, ferr := migrateLegacyFile(fileName, 0, dest)
+		migrated += n
+		if ferr != nil {
+			log.Errorf("MigrateLegacyQueue(%s): failed to fully migrate %s: %v", name, fileName, ferr)
+		}
+	}
+	return migrated, nil
+}
+
+// migrateLegacyFile 从 startOffset 开始，按 [4字节大端长度][payload] 的格式逐条
+// 读取 fileName，每条记录读出后直接 Put 进 dest。fileName 不存在（比如 meta 里
+// 记录的 writeFileNum 对应的文件还没被创建）视为没有数据可迁移，不是错误。
+func migrateLegacyFile(fileName string, startOffset int64, dest BackendQueue) (migrated int, err error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	if startOffset > 0 {
+		if _, err = f.Seek(startOffset, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+
+	r := bufio.NewReader(f)
+	for {
+		var length int32
+		if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return migrated, err
+		}
+		if length <= 0 || int64(length) > maxLegacyRecordBytes {
+			return migrated, fmt.Errorf("invalid record length %v", length)
+		}
+
+		record := make([]byte, length)
+		if _, err = io.ReadFull(r, record); err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				// 文件尾部是一条被截断的记录，通常是进程在写入过程中崩溃，
+				// 之前已经成功迁移的记录不受影响
+				err = nil
+			}
+			return migrated, err
+		}
+
+		if putErr := dest.Put(record); putErr != nil {
+			return migrated, fmt.Errorf("put migrated record: %v", putErr)
+		}
+		migrated++
+	}
+}
@@ -0,0 +1,525 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/qiniu/log"
+)
+
+const (
+	// defaultGroupCommitInterval Put 调用在内存中累积等待一起落盘的最长时间
+	defaultGroupCommitInterval = 5 * time.Millisecond
+	// directIOAlignment O_DIRECT 要求的写缓冲对齐大小
+	directIOAlignment = 512
+)
+
+// DiskQueueV2 是兼容 NSQ diskqueue 设计的长度前缀二进制队列：
+// 每条记录在磁盘上的布局为 [4字节大端长度][payload][4字节CRC32]，记录在单个
+// segment 文件内首尾相接，写入位置达到 maxBytesPerFile 后切换到下一个 segment
+// 文件。切换发生在一批组提交写完之后，所以单个文件可能略超过 maxBytesPerFile。与旧版
+// 逐条 JSON 编码不同，一条记录损坏（例如进程在写入过程中崩溃）只会导致该
+// 记录本身被跳过，不会拖垮整个 segment 的反序列化。
+//
+// Put 调用不再各自触发一次 write()+fsync()：请求先进入一个 pending 列表，由
+// ioLoop 这个唯一的写入者按 groupCommitInterval 或 writeLimitBytes 中先满足
+// 的条件，将累积的多条记录合并成一次 write() 和一次 fsync()，再把结果通过
+// 每个调用各自的 respChan 返回，用组提交换取更低的写放大。
+//
+// 队列的读写位置保存在独立的 meta 文件中，每 syncEvery 次组提交写入或每
+// syncTimeout 同步一次，Close 时也会强制同步一次，从而保证重启后可以从
+// 断点继续读写。
+type DiskQueueV2 struct {
+	sync.RWMutex
+
+	name            string
+	dataPath        string
+	maxBytesPerFile int64
+	syncEvery       int64
+	syncTimeout     time.Duration
+
+	groupCommitInterval time.Duration
+	writeLimitBytes     int64
+	directIO            bool
+
+	readFileNum  int64
+	writeFileNum int64
+	readPos      int64
+	writePos     int64
+	depth        int64
+
+	readFile  *os.File
+	writeFile *os.File
+	reader    *bufio.Reader
+	writeBuf  bytes.Buffer
+
+	writeChan    chan *writeRequest
+	readChan     chan []byte
+	exitChan     chan int
+	exitSyncChan chan int
+
+	writesSinceLastSync int64
+}
+
+// writeRequest 是一次 Put 调用在内存中的表示，respChan 用于把这一批的落盘
+// 结果单独返回给发起 Put 的 goroutine。
+type writeRequest struct {
+	data     []byte
+	respChan chan error
+}
+
+// NewDiskQueueV2 构造一个 v2 格式的磁盘队列，目录 dataPath 必须已经存在。
+// groupCommitInterval <= 0 时使用 defaultGroupCommitInterval；writeLimitBytes
+// <= 0 时组提交只按时间间隔触发，不按累积字节数触发。
+func NewDiskQueueV2(name, dataPath string, maxBytesPerFile int64, syncEvery int64, syncTimeout time.Duration, groupCommitInterval time.Duration, writeLimitBytes int64, directIO bool) BackendQueue {
+	if groupCommitInterval <= 0 {
+		groupCommitInterval = defaultGroupCommitInterval
+	}
+	d := &DiskQueueV2{
+		name:                name,
+		dataPath:            dataPath,
+		maxBytesPerFile:     maxBytesPerFile,
+		syncEvery:           syncEvery,
+		syncTimeout:         syncTimeout,
+		groupCommitInterval: groupCommitInterval,
+		writeLimitBytes:     writeLimitBytes,
+		directIO:            directIO,
+		writeChan:           make(chan *writeRequest),
+		readChan:            make(chan []byte),
+		exitChan:            make(chan int),
+		exitSyncChan:        make(chan int),
+	}
+
+	if err := d.retrieveMetaData(); err != nil && !os.IsNotExist(err) {
+		log.Errorf("DiskQueueV2(%s) failed to retrieveMetaData: %v", d.name, err)
+	}
+
+	go d.ioLoop()
+	return d
+}
+
+func (d *DiskQueueV2) Name() string {
+	return d.name
+}
+
+func (d *DiskQueueV2) Depth() int64 {
+	return atomic.LoadInt64(&d.depth)
+}
+
+func (d *DiskQueueV2) ReadChan() <-chan []byte {
+	return d.readChan
+}
+
+func (d *DiskQueueV2) Put(data []byte) error {
+	d.RLock()
+	defer d.RUnlock()
+
+	req := &writeRequest{data: data, respChan: make(chan error, 1)}
+	d.writeChan <- req
+	return <-req.respChan
+}
+
+func (d *DiskQueueV2) Close() error {
+	d.exitChan <- 1
+	<-d.exitSyncChan
+	return d.sync()
+}
+
+func (d *DiskQueueV2) Delete() error {
+	d.exitChan <- 1
+	<-d.exitSyncChan
+	return os.RemoveAll(d.dataPath)
+}
+
+// metaDataFileName 与 fileName 沿用 NSQ diskqueue 约定的命名方式，
+// <name>.diskqueue.meta.dat 与 <name>.diskqueue.<fileNum>.dat。
+func (d *DiskQueueV2) metaDataFileName() string {
+	return path.Join(d.dataPath, fmt.Sprintf("%s.diskqueue.meta.dat", d.name))
+}
+
+func (d *DiskQueueV2) fileName(fileNum int64) string {
+	return path.Join(d.dataPath, fmt.Sprintf("%s.diskqueue.%06d.dat", d.name, fileNum))
+}
+
+type diskQueueV2Meta struct {
+	Depth        int64 `json:"depth"`
+	ReadFileNum  int64 `json:"read_file_num"`
+	ReadPos      int64 `json:"read_pos"`
+	WriteFileNum int64 `json:"write_file_num"`
+	WritePos     int64 `json:"write_pos"`
+}
+
+func (d *DiskQueueV2) persistMetaData() error {
+	fileName := d.metaDataFileName()
+	tmpFileName := fileName + ".tmp"
+
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	meta := diskQueueV2Meta{
+		Depth:        d.depth,
+		ReadFileNum:  d.readFileNum,
+		ReadPos:      d.readPos,
+		WriteFileNum: d.writeFileNum,
+		WritePos:     d.writePos,
+	}
+	err = json.NewEncoder(f).Encode(&meta)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+
+	return os.Rename(tmpFileName, fileName)
+}
+
+func (d *DiskQueueV2) retrieveMetaData() error {
+	f, err := os.OpenFile(d.metaDataFileName(), os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var meta diskQueueV2Meta
+	if err := json.NewDecoder(f).Decode(&meta); err != nil {
+		return err
+	}
+
+	d.depth = meta.Depth
+	d.readFileNum = meta.ReadFileNum
+	d.readPos = meta.ReadPos
+	d.writeFileNum = meta.WriteFileNum
+	d.writePos = meta.WritePos
+	return nil
+}
+
+// openWriteFile 打开（directIO 开启时以 O_DIRECT 打开）当前 segment 文件用于写入，
+// 并 seek 到上次写入的位置。
+//
+// O_DIRECT 写入要求文件偏移按 directIOAlignment 对齐，但 writePos 可能是上一次
+// 以非 directIO 方式写入遗留下来的、不对齐的偏移（比如 ft_direct_io 在两次启动
+// 之间被打开）。继续在这个偏移上用 O_DIRECT 写入会被内核以 EINVAL 拒绝，这里
+// 换到一个新的 segment 文件重新开始，而不是尝试修复旧文件里这段不对齐的写入
+// 历史。反过来从 directIO 切到非 directIO 不需要特殊处理，因为 buffered IO 对
+// 偏移没有对齐要求。
+func (d *DiskQueueV2) openWriteFile() error {
+	if d.directIO && d.writePos%directIOAlignment != 0 {
+		d.writeFileNum++
+		d.writePos = 0
+	}
+	curFileName := d.fileName(d.writeFileNum)
+	var f *os.File
+	var err error
+	if d.directIO {
+		f, err = openFileDirectIO(curFileName)
+	} else {
+		f, err = os.OpenFile(curFileName, os.O_RDWR|os.O_CREATE, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	if d.writePos > 0 {
+		if _, err = f.Seek(d.writePos, 0); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	d.writeFile = f
+	return nil
+}
+
+// flushPending 把一批 Put 请求编码后合并为一次 write() + 一次 fsync()，这是
+// group commit 的核心：无论这一批里有多少条记录，磁盘 IO 只发生一次。directIO
+// 模式下会在缓冲区末尾补一条"填充记录"（length 为负数，表示后面跟的是
+// padLen 字节无需校验的填充数据）把写入长度补齐到 512 字节对齐，readOne 读到
+// 负数长度时会直接跳过这段填充，不会当作真实消息返回。
+func (d *DiskQueueV2) flushPending(pending []*writeRequest) {
+	if len(pending) == 0 {
+		return
+	}
+	if d.writeFile == nil {
+		if err := d.openWriteFile(); err != nil {
+			respondAll(pending, err)
+			return
+		}
+	}
+
+	d.writeBuf.Reset()
+	for _, req := range pending {
+		binary.Write(&d.writeBuf, binary.BigEndian, int32(len(req.data)))
+		d.writeBuf.Write(req.data)
+		binary.Write(&d.writeBuf, binary.BigEndian, crc32.ChecksumIEEE(req.data))
+	}
+	writeBytes := d.writeBuf.Bytes()
+	if d.directIO {
+		padForDirectIO(&d.writeBuf)
+		// O_DIRECT 要求缓冲区本身的内存地址按 directIOAlignment 对齐，光对齐
+		// 数据长度（padForDirectIO）不够：bytes.Buffer 的底层数组地址是任意
+		// 的，直接写入会被内核以 EINVAL 拒绝，所以这里拷贝进一块按地址对齐
+		// 的缓冲区再落盘。
+		aligned := alignedBytes(d.writeBuf.Len())
+		copy(aligned, d.writeBuf.Bytes())
+		writeBytes = aligned
+	}
+
+	n, err := d.writeFile.Write(writeBytes)
+	if err != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+		respondAll(pending, err)
+		return
+	}
+	if err = d.writeFile.Sync(); err != nil {
+		respondAll(pending, err)
+		return
+	}
+
+	d.writePos += int64(n)
+	atomic.AddInt64(&d.depth, int64(len(pending)))
+	respondAll(pending, nil)
+
+	if d.writePos >= d.maxBytesPerFile {
+		d.writeFile.Close()
+		d.writeFile = nil
+		d.writeFileNum++
+		d.writePos = 0
+	}
+}
+
+func respondAll(pending []*writeRequest, err error) {
+	for _, req := range pending {
+		req.respChan <- err
+	}
+}
+
+// padForDirectIO 在 buf 末尾补一条填充记录，使 buf 的长度对齐到
+// directIOAlignment。填充记录的 length 字段写成负数，readOne 据此识别并跳过。
+func padForDirectIO(buf *bytes.Buffer) {
+	rem := buf.Len() % directIOAlignment
+	if rem == 0 {
+		return
+	}
+	totalPad := directIOAlignment - rem
+	// 至少留 1 字节填充，保证 length 字段是负数而不是 0
+	if totalPad <= 4 {
+		totalPad += directIOAlignment
+	}
+	padLen := totalPad - 4
+	binary.Write(buf, binary.BigEndian, int32(-padLen))
+	if padLen > 0 {
+		buf.Write(make([]byte, padLen))
+	}
+}
+
+// alignedBytes 返回一个长度为 n、起始内存地址按 directIOAlignment 对齐的切片。
+// O_DIRECT 写入同时要求缓冲区的长度和内存地址对齐，padForDirectIO 只处理了
+// 长度，这里通过多分配 directIOAlignment 字节再裁剪起始偏移来保证地址对齐。
+func alignedBytes(n int) []byte {
+	buf := make([]byte, n+directIOAlignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0]))) % directIOAlignment; rem != 0 {
+		offset = directIOAlignment - rem
+	}
+	return buf[offset : offset+n]
+}
+
+// readOne 读取下一条真实记录，跳过 directIO 填充记录，并校验 CRC32。CRC 不
+// 匹配（通常是进程崩溃导致的尾部半条记录）时跳过该记录并返回错误，而不会
+// 影响后续记录的读取。
+func (d *DiskQueueV2) readOne() ([]byte, error) {
+	for {
+		var err error
+		if d.readFile == nil {
+			curFileName := d.fileName(d.readFileNum)
+			d.readFile, err = os.OpenFile(curFileName, os.O_RDONLY, 0600)
+			if err != nil {
+				return nil, err
+			}
+			if d.readPos > 0 {
+				if _, err = d.readFile.Seek(d.readPos, 0); err != nil {
+					d.readFile.Close()
+					d.readFile = nil
+					return nil, err
+				}
+			}
+			d.reader = bufio.NewReader(d.readFile)
+		}
+
+		var length int32
+		err = binary.Read(d.reader, binary.BigEndian, &length)
+		if err != nil {
+			if err == io.EOF && d.readFileNum < d.writeFileNum {
+				// 写入方已经换到后面的 segment（例如 openWriteFile 跳过了不对齐的
+				// 尾部），当前文件不会再有新数据，跟着切到下一个文件
+				d.readFile.Close()
+				d.readFile = nil
+				d.readFileNum++
+				d.readPos = 0
+				continue
+			}
+			return nil, err
+		}
+
+		if length < 0 {
+			padLen := int64(-length)
+			if padLen > 0 {
+				if _, err = io.CopyN(ioutil.Discard, d.reader, padLen); err != nil {
+					return nil, err
+				}
+			}
+			d.advance(4+padLen, false)
+			continue
+		}
+
+		data := make([]byte, length)
+		if _, err = io.ReadFull(d.reader, data); err != nil {
+			return nil, err
+		}
+
+		var crc uint32
+		if err = binary.Read(d.reader, binary.BigEndian, &crc); err != nil {
+			return nil, err
+		}
+		if crc != crc32.ChecksumIEEE(data) {
+			err = fmt.Errorf("DiskQueueV2(%s): crc mismatch, record at %s:%d skipped", d.name, d.fileName(d.readFileNum), d.readPos)
+			d.advance(int64(4+len(data)+4), true)
+			return nil, err
+		}
+
+		d.advance(int64(4+len(data)+4), true)
+		return data, nil
+	}
+}
+
+// advance 推进读指针 totalBytes 字节；isMessage 为 true 时同时减少 depth，
+// directIO 的填充记录不是真实消息，不计入 depth。
+func (d *DiskQueueV2) advance(totalBytes int64, isMessage bool) {
+	d.readPos += totalBytes
+	if isMessage {
+		atomic.AddInt64(&d.depth, -1)
+	}
+
+	if d.readPos >= d.maxBytesPerFile {
+		if d.readFile != nil {
+			d.readFile.Close()
+			d.readFile = nil
+		}
+		d.readFileNum++
+		d.readPos = 0
+	}
+}
+
+func (d *DiskQueueV2) sync() error {
+	if d.writeFile != nil {
+		if err := d.writeFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := d.persistMetaData(); err != nil {
+		return err
+	}
+	d.writesSinceLastSync = 0
+	return nil
+}
+
+// ioLoop 是唯一的读写者：读路径按需 readOne 一条记录送上 readChan；写路径把
+// 到达的 Put 请求攒进 pending，直到 groupCommitInterval 定时器触发或累积字节数
+// 达到 writeLimitBytes 才调用一次 flushPending，实现组提交。
+func (d *DiskQueueV2) ioLoop() {
+	var dataRead []byte
+	var err error
+	syncTicker := time.NewTicker(d.syncTimeout)
+	groupTicker := time.NewTicker(d.groupCommitInterval)
+
+	var pending []*writeRequest
+	var pendingBytes int64
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		d.flushPending(pending)
+		d.writesSinceLastSync++
+		pending = pending[:0]
+		pendingBytes = 0
+	}
+
+	for {
+		if d.writesSinceLastSync > 0 && d.writesSinceLastSync >= d.syncEvery {
+			flush()
+			if err = d.sync(); err != nil {
+				log.Errorf("DiskQueueV2(%s) failed to sync: %v", d.name, err)
+			}
+		}
+
+		if d.readFileNum < d.writeFileNum || d.readPos < d.writePos {
+			if dataRead == nil {
+				dataRead, err = d.readOne()
+				if err != nil {
+					log.Errorf("DiskQueueV2(%s) reading at %d: %v", d.name, d.readPos, err)
+					dataRead = nil
+					continue
+				}
+			}
+		}
+
+		var readChan chan []byte
+		if dataRead != nil {
+			readChan = d.readChan
+		}
+
+		select {
+		case readChan <- dataRead:
+			dataRead = nil
+		case req := <-d.writeChan:
+			pending = append(pending, req)
+			pendingBytes += int64(4 + len(req.data) + 4)
+			if d.writeLimitBytes > 0 && pendingBytes >= d.writeLimitBytes {
+				flush()
+			}
+		case <-groupTicker.C:
+			flush()
+		case <-syncTicker.C:
+			flush()
+			if d.writesSinceLastSync > 0 {
+				if err = d.sync(); err != nil {
+					log.Errorf("DiskQueueV2(%s) failed to sync: %v", d.name, err)
+				}
+			}
+		case <-d.exitChan:
+			flush()
+			goto exit
+		}
+	}
+
+exit:
+	log.Infof("DiskQueueV2(%s): closing ... ioLoop", d.name)
+	groupTicker.Stop()
+	syncTicker.Stop()
+	if d.readFile != nil {
+		d.readFile.Close()
+		d.readFile = nil
+	}
+	// 置空 writeFile，Close 之后调用的 sync() 才不会对已关闭的文件 Sync 报错，
+	// 从而能够把 meta 落盘
+	if d.writeFile != nil {
+		d.writeFile.Close()
+		d.writeFile = nil
+	}
+	d.exitSyncChan <- 1
+}
@@ -0,0 +1,202 @@
+package queue
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/qiniu/log"
+)
+
+// BackendKV 是 ft_backend 配置项里选择内嵌 KV 队列时使用的名字
+const BackendKV = "kv"
+
+func init() {
+	Register(BackendKV, func(name string, conf map[string]interface{}) (BackendQueue, error) {
+		path, _ := conf["path"].(string)
+		return NewKVQueue(name, path)
+	})
+}
+
+// KVQueue 是一个基于内嵌 LSM 存储（BadgerDB，纯 Go 实现，相比 RocksDB 不需要
+// cgo）的 BackendQueue 实现：每条入队的数据以 <seq uint64 大端> 为 key 写入，
+// Depth() 即 writeSeq-readSeq，ReadChan() 内部用一个顺序扫描的游标模拟迭代器
+// 按 key 顺序流式读取，数据一旦被投递到 ReadChan 即视为已确认并删除对应的 key，
+// 与 DiskQueueV2 读指针前移即不可回退的语义保持一致。
+type KVQueue struct {
+	name string
+	path string
+	db   *badger.DB
+
+	writeMu  sync.Mutex // 串行化 seq 分配与对应 key 的写入提交，见 Put 的注释
+	writeSeq uint64
+	readSeq  uint64
+
+	readChan chan []byte
+	exitChan chan struct{}
+	doneChan chan struct{}
+}
+
+// NewKVQueue 打开（或创建）path 目录下的 BadgerDB 实例作为 name 队列的存储
+func NewKVQueue(name, path string) (*KVQueue, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &KVQueue{
+		name:     name,
+		path:     path,
+		db:       db,
+		readChan: make(chan []byte),
+		exitChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+	if err = q.restoreSeq(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go q.ioLoop()
+	return q, nil
+}
+
+// restoreSeq 重启后通过一次全量 key 扫描恢复 readSeq/writeSeq，
+// 只在打开队列时执行一次，不影响正常读写路径的性能
+func (q *KVQueue) restoreSeq() error {
+	return q.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		var minSeq, maxSeq uint64
+		var has bool
+		for it.Rewind(); it.Valid(); it.Next() {
+			seq := decodeSeqKey(it.Item().KeyCopy(nil))
+			if !has {
+				minSeq, maxSeq, has = seq, seq, true
+				continue
+			}
+			if seq < minSeq {
+				minSeq = seq
+			}
+			if seq > maxSeq {
+				maxSeq = seq
+			}
+		}
+		if has {
+			q.readSeq = minSeq
+			q.writeSeq = maxSeq + 1
+		}
+		return nil
+	})
+}
+
+func encodeSeqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func decodeSeqKey(key []byte) uint64 {
+	return binary.BigEndian.Uint64(key)
+}
+
+func (q *KVQueue) Name() string {
+	return q.name
+}
+
+func (q *KVQueue) Depth() int64 {
+	return int64(atomic.LoadUint64(&q.writeSeq) - atomic.LoadUint64(&q.readSeq))
+}
+
+// Put 先提交 key 写入，成功后才推进 writeSeq，确保 ioLoop 只会看到已经可见的
+// seq：如果反过来先推进 writeSeq 再提交，ioLoop 有可能在提交完成前就读到
+// readSeq < writeSeq 从而对尚未写入的 key 做 Get，拿到 ErrKeyNotFound 后把
+// readSeq 永久跳过，导致这条消息再也不会被投递。writeMu 把“分配 seq + 提交”
+// 这两步串成一个临界区，避免并发 Put 抢到同一个 seq。
+func (q *KVQueue) Put(data []byte) error {
+	value := make([]byte, len(data))
+	copy(value, data)
+
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+
+	seq := q.writeSeq
+	if err := q.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(encodeSeqKey(seq), value)
+	}); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&q.writeSeq, seq+1)
+	return nil
+}
+
+func (q *KVQueue) ReadChan() <-chan []byte {
+	return q.readChan
+}
+
+// ioLoop 按 readSeq 递增的顺序逐条读取并投递数据，投递成功（被下游消费）后立
+// 即删除对应的 key 并推进 readSeq。若某个 seq 不存在（比如启动时 key 被后续
+// 写入覆盖或手工清理过），直接跳过该 seq，避免读指针卡死。
+func (q *KVQueue) ioLoop() {
+	defer close(q.doneChan)
+	for {
+		var key []byte
+		var data []byte
+		if atomic.LoadUint64(&q.readSeq) < atomic.LoadUint64(&q.writeSeq) {
+			seq := atomic.LoadUint64(&q.readSeq)
+			key = encodeSeqKey(seq)
+			err := q.db.View(func(txn *badger.Txn) error {
+				item, err := txn.Get(key)
+				if err != nil {
+					return err
+				}
+				data, err = item.ValueCopy(nil)
+				return err
+			})
+			if err != nil {
+				if err != badger.ErrKeyNotFound {
+					log.Errorf("KVQueue(%v) read seq %v failed: %v", q.name, seq, err)
+				}
+				atomic.AddUint64(&q.readSeq, 1)
+				continue
+			}
+		}
+
+		var readChan chan []byte
+		if data != nil {
+			readChan = q.readChan
+		}
+
+		select {
+		case readChan <- data:
+			if err := q.db.Update(func(txn *badger.Txn) error {
+				return txn.Delete(key)
+			}); err != nil {
+				log.Errorf("KVQueue(%v) delete delivered key failed: %v", q.name, err)
+			}
+			atomic.AddUint64(&q.readSeq, 1)
+		case <-q.exitChan:
+			return
+		case <-time.After(time.Second):
+			continue
+		}
+	}
+}
+
+func (q *KVQueue) Close() error {
+	close(q.exitChan)
+	<-q.doneChan
+	return q.db.Close()
+}
+
+func (q *KVQueue) Delete() error {
+	if err := q.Close(); err != nil {
+		return err
+	}
+	return os.RemoveAll(q.path)
+}
@@ -0,0 +1,42 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Factory 根据队列名称和一组自由格式的配置构造一个 BackendQueue 实例，
+// 具体实现在各自的文件里通过 init() 调用 Register 注册；目前只有 kv（见
+// kv_queue.go）这样注册，disk 和 memory 队列仍由调用方直接构造。
+type Factory func(name string, conf map[string]interface{}) (BackendQueue, error)
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]Factory)
+)
+
+// Register 注册一个 BackendQueue 实现，backend 对应 FtSender 配置项
+// ft_backend 的取值（如 "kv"）。重复注册同一个 backend 名字会 panic，
+// 与 database/sql 等标准库 driver 注册的约定一致。
+func Register(backend string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("queue: Register factory is nil for backend " + backend)
+	}
+	if _, dup := registry[backend]; dup {
+		panic("queue: Register called twice for backend " + backend)
+	}
+	registry[backend] = factory
+}
+
+// New 按 backend 名字查找已注册的 factory 并构造一个 BackendQueue。
+func New(backend, name string, conf map[string]interface{}) (BackendQueue, error) {
+	registryMu.Lock()
+	factory, ok := registry[backend]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("queue: unknown backend %q", backend)
+	}
+	return factory(name, conf)
+}
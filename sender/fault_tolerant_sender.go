@@ -2,7 +2,11 @@ package sender
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -14,23 +18,50 @@ import (
 )
 
 const (
-	mb                = 1024 * 1024 // 1MB
-	defaultWriteLimit = 10          // 默认写速限制为10MB
-	maxBytesPerFile   = 100 * mb
-	qNameSuffix       = "_local_save"
-	memoryChanSuffix  = "_memory"
-	defaultMaxProcs   = 1 // 默认没有并发
+	mb                 = 1024 * 1024 // 1MB
+	defaultWriteLimit  = 10          // 默认写速限制为10MB
+	maxBytesPerFile    = 100 * mb
+	qNameSuffix        = "_local_save"
+	memoryChanSuffix   = "_memory"
+	defaultMaxProcs    = 1 // 默认没有并发
+	defaultMaxAttempts = 0 // 默认不限制重试次数，不写入 deadletter
+
+	defaultGroupCommitIntervalMs = 5     // 默认组提交间隔 5ms
+	defaultDirectIO              = false // 默认不启用 O_DIRECT
 )
 
 // 可选参数 fault_tolerant 为true的话，以下必填
 const (
-	KeyFtSyncEvery         = "ft_sync_every"    // 该参数设置多少次写入会同步一次offset log
-	KeyFtSaveLogPath       = "ft_save_log_path" // disk queue 数据日志路径
-	KeyFtWriteLimit        = "ft_write_limit"   // 写入速度限制，单位MB
-	KeyFtStrategy          = "ft_strategy"      // ft 的策略
-	KeyFtProcs             = "ft_procs"         // ft并发数，当always_save 策略时启用
-	KeyFtMemoryChannel     = "ft_memory_channel"
-	KeyFtMemoryChannelSize = "ft_memory_channel_size"
+	KeyFtSyncEvery           = "ft_sync_every"    // 该参数设置多少次写入会同步一次offset log
+	KeyFtSaveLogPath         = "ft_save_log_path" // disk queue 数据日志路径
+	KeyFtWriteLimit          = "ft_write_limit"   // 写入速度限制，单位MB
+	KeyFtStrategy            = "ft_strategy"      // ft 的策略
+	KeyFtProcs               = "ft_procs"         // ft并发数，当always_save 策略时启用
+	KeyFtMemoryChannel       = "ft_memory_channel"
+	KeyFtMemoryChannelSize   = "ft_memory_channel_size"
+	KeyFtQueueFormat         = "ft_queue_format"          // 磁盘队列存储格式，v1(默认) 或 v2
+	KeyFtMaxAttempts         = "ft_max_attempts"          // 单条数据最大重试次数，超过后写入 deadletter 队列，0 表示不限制
+	KeyFtGroupCommitInterval = "ft_group_commit_interval" // v2 队列组提交的时间间隔，单位毫秒，仅在 ft_queue_format 为 v2 时生效
+	KeyFtDirectIO            = "ft_direct_io"             // v2 队列是否以 O_DIRECT 打开 segment 文件，仅在 ft_queue_format 为 v2 时生效
+	KeyFtBackend             = "ft_backend"               // 队列后端类型，disk(默认)|memory|kv
+	KeyFtBackendPath         = "ft_backend_path"          // ft_backend 为 kv 时，内嵌 KV 存储的数据目录
+)
+
+// ft 队列后端类型
+const (
+	KeyFtBackendDisk   = "disk"
+	KeyFtBackendMemory = "memory"
+	// KeyFtBackendKV 使用内嵌的 LSM KV 存储（参见 queue.KVQueue），
+	// 相比 disk 后端支持乱序 ack 和自带的崩溃恢复
+	KeyFtBackendKV = "kv"
+)
+
+// ft 磁盘队列存储格式
+const (
+	// KeyFtQueueFormatV1 每条记录为独立的 JSON blob，带 4 字节长度前缀，不做 CRC 校验
+	KeyFtQueueFormatV1 = "v1"
+	// KeyFtQueueFormatV2 长度前缀 + CRC32 的二进制记录格式，兼容 NSQ diskqueue 设计
+	KeyFtQueueFormatV2 = "v2"
 )
 
 // ft 策略
@@ -43,27 +74,45 @@ const (
 
 // FtSender fault tolerance sender wrapper
 type FtSender struct {
-	stopped     int32
-	exitChan    chan struct{}
-	innerSender Sender
-	logQueue    queue.BackendQueue
-	backupQueue queue.BackendQueue
-	writeLimit  int  // 写入速度限制，单位MB
-	backupOnly  bool // 是否只使用backup queue
-	procs       int  //发送并发数
-	se          *utils.StatsError
-	runnerName  string
-	opt         *FtOption
+	stopped         int32
+	exitChan        chan struct{}
+	scanExitChan    chan struct{}
+	innerSender     Sender
+	logQueue        queue.BackendQueue
+	backupQueue     queue.BackendQueue
+	deadletterQueue queue.BackendQueue
+	writeLimit      int  // 写入速度限制，单位MB
+	backupOnly      bool // 是否只使用backup queue
+	procs           int  //发送并发数
+	maxAttempts     int  // 单条数据最大重试次数，0 表示不限制
+	se              *utils.StatsError
+	runnerName      string
+	opt             *FtOption
+
+	msgIDSeq uint64
+	inFlight *inFlightTracker
+	deferred *deferredTracker
+
+	scheduler *Scheduler
 }
 
 type FtOption struct {
-	saveLogPath       string
-	syncEvery         int64
-	writeLimit        int
-	backupOnly        bool
-	procs             int
-	memoryChannel     bool
-	memoryChannelSize int
+	saveLogPath           string
+	syncEvery             int64
+	writeLimit            int
+	backupOnly            bool
+	procs                 int
+	memoryChannel         bool
+	memoryChannelSize     int
+	queueFormat           string
+	maxAttempts           int
+	maxConcurrent         int
+	longTailMarginMs      int
+	hedgePercentile       float64
+	groupCommitIntervalMs int
+	directIO              bool
+	backend               string
+	backendPath           string
 }
 
 type datasContext struct {
@@ -74,67 +123,166 @@ type datasContext struct {
 func NewFtSender(sender Sender, conf conf.MapConf) (*FtSender, error) {
 	memoryChannel, _ := conf.GetBoolOr(KeyFtMemoryChannel, false)
 	memoryChannelSize, _ := conf.GetIntOr(KeyFtMemoryChannelSize, 100)
+	backend, _ := conf.GetStringOr(KeyFtBackend, "")
+	backendPath, _ := conf.GetStringOr(KeyFtBackendPath, "")
+
+	if backend == "" {
+		// 兼容旧版只有 ft_memory_channel 开关的配置
+		if memoryChannel {
+			backend = KeyFtBackendMemory
+		} else {
+			backend = KeyFtBackendDisk
+		}
+	}
 
 	logpath, err := conf.GetString(KeyFtSaveLogPath)
-	if !memoryChannel && err != nil {
+	if backend == KeyFtBackendDisk && err != nil {
 		return nil, err
 	}
+	if backend == KeyFtBackendKV && backendPath == "" {
+		return nil, fmt.Errorf("%v must be set when %v is %q", KeyFtBackendPath, KeyFtBackend, KeyFtBackendKV)
+	}
 	syncEvery, _ := conf.GetIntOr(KeyFtSyncEvery, DefaultFtSyncEvery)
 	writeLimit, _ := conf.GetIntOr(KeyFtWriteLimit, defaultWriteLimit)
 	strategy, _ := conf.GetStringOr(KeyFtStrategy, KeyFtStrategyAlwaysSave)
 	procs, _ := conf.GetIntOr(KeyFtProcs, defaultMaxProcs)
 	runnerName, _ := conf.GetStringOr(KeyRunnerName, UnderfinedRunnerName)
+	queueFormat, _ := conf.GetStringOr(KeyFtQueueFormat, KeyFtQueueFormatV1)
+	maxAttempts, _ := conf.GetIntOr(KeyFtMaxAttempts, defaultMaxAttempts)
+	maxConcurrent, _ := conf.GetIntOr(KeyFtMaxConcurrent, defaultMaxConcurrent)
+	longTailMarginMs, _ := conf.GetIntOr(KeyFtLongTailMarginMs, defaultLongTailMarginMs)
+	hedgePercentile := defaultHedgeAfterPercentile
+	if hedgePercentileStr, _ := conf.GetStringOr(KeyFtHedgeAfterPercentile, ""); hedgePercentileStr != "" {
+		if v, perr := strconv.ParseFloat(hedgePercentileStr, 64); perr == nil {
+			hedgePercentile = v
+		}
+	}
+	groupCommitIntervalMs, _ := conf.GetIntOr(KeyFtGroupCommitInterval, defaultGroupCommitIntervalMs)
+	directIO, _ := conf.GetBoolOr(KeyFtDirectIO, defaultDirectIO)
 
 	opt := &FtOption{
-		saveLogPath:       logpath,
-		syncEvery:         int64(syncEvery),
-		writeLimit:        writeLimit,
-		backupOnly:        strategy == KeyFtStrategyBackupOnly,
-		procs:             procs,
-		memoryChannel:     memoryChannel,
-		memoryChannelSize: memoryChannelSize,
+		saveLogPath:           logpath,
+		syncEvery:             int64(syncEvery),
+		writeLimit:            writeLimit,
+		backupOnly:            strategy == KeyFtStrategyBackupOnly,
+		procs:                 procs,
+		memoryChannel:         memoryChannel,
+		memoryChannelSize:     memoryChannelSize,
+		queueFormat:           queueFormat,
+		maxAttempts:           maxAttempts,
+		maxConcurrent:         maxConcurrent,
+		longTailMarginMs:      longTailMarginMs,
+		hedgePercentile:       hedgePercentile,
+		groupCommitIntervalMs: groupCommitIntervalMs,
+		directIO:              directIO,
+		backend:               backend,
+		backendPath:           backendPath,
 	}
 
 	return newFtSender(sender, runnerName, opt)
 }
 
 func newFtSender(innerSender Sender, runnerName string, opt *FtOption) (*FtSender, error) {
-	var lq, bq queue.BackendQueue
-	if !opt.memoryChannel {
-		err := utils.CreateDirIfNotExist(opt.saveLogPath)
-		if err != nil {
+	createDir := opt.saveLogPath
+	if opt.backend == KeyFtBackendKV {
+		createDir = opt.backendPath
+	}
+	if opt.backend != KeyFtBackendMemory {
+		if err := utils.CreateDirIfNotExist(createDir); err != nil {
 			return nil, err
 		}
+	}
 
-		lq = queue.NewDiskQueue("stream"+qNameSuffix, opt.saveLogPath, maxBytesPerFile, 0, maxBytesPerFile, opt.syncEvery, opt.syncEvery, time.Second*2, opt.writeLimit*mb)
-		bq = queue.NewDiskQueue("backup"+qNameSuffix, opt.saveLogPath, maxBytesPerFile, 0, maxBytesPerFile, opt.syncEvery, opt.syncEvery, time.Second*2, opt.writeLimit*mb)
-	} else {
-		lq = queue.NewMemoryQueue("steam"+memoryChanSuffix, opt.memoryChannelSize)
-		bq = queue.NewMemoryQueue("backup"+memoryChanSuffix, opt.memoryChannelSize)
+	if opt.longTailMarginMs > 0 {
+		if _, ok := innerSender.(CtxSender); !ok {
+			log.Warnf("Runner[%v] Sender[%v] has %v=%v configured but does not implement CtxSender.SendCtx, so long-tail hedging is a no-op until a sender adopts that interface",
+				runnerName, innerSender.Name(), KeyFtLongTailMarginMs, opt.longTailMarginMs)
+		}
+	}
+
+	lq, err := newBackendQueue("stream", opt)
+	if err != nil {
+		return nil, err
+	}
+	bq, err := newBackendQueue("backup", opt)
+	if err != nil {
+		return nil, err
 	}
+	dq, err := newBackendQueue("deadletter", opt)
+	if err != nil {
+		return nil, err
+	}
+
 	ftSender := FtSender{
-		exitChan:    make(chan struct{}),
-		innerSender: innerSender,
-		logQueue:    lq,
-		backupQueue: bq,
-		writeLimit:  opt.writeLimit,
-		backupOnly:  opt.backupOnly,
-		procs:       opt.procs,
-		se:          &utils.StatsError{Ft: true},
-		runnerName:  runnerName,
+		exitChan:        make(chan struct{}),
+		scanExitChan:    make(chan struct{}),
+		innerSender:     innerSender,
+		logQueue:        lq,
+		backupQueue:     bq,
+		deadletterQueue: dq,
+		writeLimit:      opt.writeLimit,
+		backupOnly:      opt.backupOnly,
+		procs:           opt.procs,
+		maxAttempts:     opt.maxAttempts,
+		se:              &utils.StatsError{Ft: true},
+		runnerName:      runnerName,
+		inFlight:        newInFlightTracker(),
+		deferred:        newDeferredTracker(),
+		scheduler:       getOrCreateScheduler(runnerName, opt.maxConcurrent, time.Duration(opt.longTailMarginMs)*time.Millisecond, opt.hedgePercentile),
 	}
 	go ftSender.asyncSendLogFromDiskQueue()
+	go ftSender.queueScanLoop()
 	return &ftSender, nil
 }
 
+// newBackendQueue 按 opt.backend 选择的后端类型构造一个 BackendQueue，base 是不
+// 带后缀的队列名（如 "stream"、"backup"、"deadletter"），具体后缀由各后端自行追加
+func newBackendQueue(base string, opt *FtOption) (queue.BackendQueue, error) {
+	switch opt.backend {
+	case KeyFtBackendMemory:
+		return queue.NewMemoryQueue(base+memoryChanSuffix, opt.memoryChannelSize), nil
+	case KeyFtBackendKV:
+		name := base + qNameSuffix
+		return queue.New(queue.BackendKV, name, map[string]interface{}{
+			"path": filepath.Join(opt.backendPath, name),
+		})
+	default:
+		name := base + qNameSuffix
+		if opt.queueFormat == KeyFtQueueFormatV2 {
+			return newDiskQueueV2WithMigration(name, opt.saveLogPath, opt), nil
+		}
+		return queue.NewDiskQueue(name, opt.saveLogPath, maxBytesPerFile, 0, maxBytesPerFile, opt.syncEvery, opt.syncEvery, time.Second*2, opt.writeLimit*mb), nil
+	}
+}
+
+// newDiskQueueV2WithMigration 创建一个 v2 格式的磁盘队列，并在创建后立即将同名的旧版
+// JSON 队列文件迁移进去，迁移完成后旧文件不会被删除，方便人工核对和回滚。
+//
+// v2 队列使用 name+".v2" 作为自己的文件名前缀，而不是直接复用 name：旧版
+// queue.DiskQueue 的 segment 文件命名是 "<name>.diskqueue.%06d.dat"，与 v2 的
+// fileName() 格式完全一样，如果两者用同一个 name，MigrateLegacyQueue 还在读
+// 旧文件的同时，这里新建的 v2 队列会以 O_RDWR 打开并覆写同一个文件，读到一半
+// 的数据会被覆盖掉，造成迁移过程中的自我损坏。
+func newDiskQueueV2WithMigration(name, dataPath string, opt *FtOption) queue.BackendQueue {
+	groupCommitInterval := time.Duration(opt.groupCommitIntervalMs) * time.Millisecond
+	q := queue.NewDiskQueueV2(name+".v2", dataPath, maxBytesPerFile, opt.syncEvery, time.Second*2, groupCommitInterval, int64(opt.writeLimit)*mb, opt.directIO)
+	migrated, err := queue.MigrateLegacyQueue(dataPath, name, q)
+	if err != nil {
+		log.Errorf("newDiskQueueV2WithMigration(%v): migrate legacy queue failed: %v", name, err)
+	} else if migrated > 0 {
+		log.Infof("newDiskQueueV2WithMigration(%v): migrated %v legacy records into v2 queue", name, migrated)
+	}
+	return q
+}
+
 func (ft *FtSender) Name() string {
 	return ft.innerSender.Name() + "(ft)"
 }
 
 func (ft *FtSender) Send(datas []Data) error {
 	if ft.backupOnly {
-		// 尝试直接发送数据，当数据失败的时候会加入到本地重试队列。外部不需要重试
-		backDataContext, err := ft.trySendDatas(datas, 1)
+		// 尝试直接发送数据，失败的数据会进入 deferred 堆等待按退避时间重试。外部不需要重试
+		err := ft.trySendDatas(datas, 1)
 		if err != nil {
 			log.Warnf("Runner[%v] Sender[%v] try Send Datas err: %v", ft.runnerName, ft.innerSender.Name(), err)
 			ft.se.AddErrors()
@@ -143,16 +291,7 @@ func (ft *FtSender) Send(datas []Data) error {
 		}
 		// 容错队列会保证重试，此处不向外部暴露发送错误信息
 		ft.se.ErrorDetail = nil
-		ft.se.Ftlag = ft.backupQueue.Depth()
-		if backDataContext != nil {
-			var nowDatas []Data
-			for _, v := range backDataContext {
-				nowDatas = append(nowDatas, v.Datas...)
-			}
-			if nowDatas != nil {
-				ft.se.ErrorDetail = reqerr.NewSendError("save data to backend queue error", ConvertDatasBack(nowDatas), reqerr.TypeDefault)
-			}
-		}
+		ft.se.Ftlag = ft.ftlag()
 	} else {
 		err := ft.saveToFile(datas)
 		if err != nil {
@@ -160,7 +299,7 @@ func (ft *FtSender) Send(datas []Data) error {
 		} else {
 			ft.se.ErrorDetail = nil
 		}
-		ft.se.Ftlag = ft.backupQueue.Depth() + ft.logQueue.Depth()
+		ft.se.Ftlag = ft.ftlag()
 	}
 	return ft.se
 }
@@ -174,12 +313,16 @@ func (ft *FtSender) Close() error {
 	for i := 0; i < ft.procs; i++ {
 		<-ft.exitChan
 	}
+	// 通知 in-flight/deferred 扫描循环退出，并等待它确认
+	close(ft.scanExitChan)
+	<-ft.exitChan
 
 	log.Warnf("Runner[%v] Sender[%v] has been completely exited", ft.runnerName, ft.Name())
 
 	// persist queue's meta data
 	ft.logQueue.Close()
 	ft.backupQueue.Close()
+	ft.deadletterQueue.Close()
 
 	return ft.innerSender.Close()
 }
@@ -228,15 +371,6 @@ func (ft *FtSender) asyncSendLogFromDiskQueue() {
 	go ft.sendFromQueue(ft.backupQueue)
 }
 
-// trySend 从bytes反序列化数据后尝试发送数据
-func (ft *FtSender) trySendBytes(dat []byte, failSleep int) (backDataContext []*datasContext, err error) {
-	datas, err := ft.unmarshalData(dat)
-	if err != nil {
-		return
-	}
-	return ft.trySendDatas(datas, failSleep)
-}
-
 func ConvertDatas(ins []map[string]interface{}) []Data {
 	var datas []Data
 	for _, v := range ins {
@@ -252,21 +386,16 @@ func ConvertDatasBack(ins []Data) []map[string]interface{} {
 	return datas
 }
 
-// trySendDatas 尝试发送数据，如果失败，将失败数据加入backup queue，并睡眠指定时间。返回结果为是否正常发送
-func (ft *FtSender) trySendDatas(datas []Data, failSleep int) (backDataContext []*datasContext, err error) {
-	err = ft.innerSender.Send(datas)
+// trySendDatas 尝试发送数据，如果失败，将失败数据按退避时间放入 deferred 堆等待重试，
+// 并睡眠指定时间。返回结果为是否正常发送
+func (ft *FtSender) trySendDatas(datas []Data, failSleep int) (err error) {
+	err = ft.scheduler.Dispatch(context.Background(), ft.innerSender, datas)
 	if c, ok := err.(*utils.StatsError); ok {
 		err = c.ErrorDetail
 	}
 	if err != nil {
-		retDatasContext := ft.handleSendError(err, datas)
-		for _, v := range retDatasContext {
-			nnBytes, _ := json.Marshal(v)
-			qErr := ft.backupQueue.Put(nnBytes)
-			if qErr != nil {
-				log.Errorf("Runner[%v] Sender[%v] cannot write points back to queue %v: %v", ft.runnerName, ft.innerSender.Name(), ft.backupQueue.Name(), qErr)
-				backDataContext = append(backDataContext, v)
-			}
+		for _, v := range ft.handleSendError(err, datas) {
+			ft.requeue(&retryableMessage{id: ft.nextMessageID(), ctx: v, fromQueue: ft.backupQueue})
 		}
 		time.Sleep(time.Second * time.Duration(failSleep))
 	}
@@ -302,48 +431,82 @@ func (ft *FtSender) handleSendError(err error, datas []Data) (retDatasContext []
 	return
 }
 
-func (ft *FtSender) sendFromQueue(queue queue.BackendQueue) {
-	readChan := queue.ReadChan()
+// sendFromQueue 从磁盘队列中取出数据并发送。每条取出的消息在发送前会注册到
+// in-flight 集合，只有明确返回成功才会被 ack，失败的消息交给 ft.requeue 按
+// 退避时间重新投递，替代了旧版 waitCnt 线性睡眠 + backupQueue 落盘重试的方式。
+// backupQueue 既是 logQueue 发送失败时兜底的落盘队列，也是 persistForRetry
+// 把退避到期的 deferred 消息重新落盘的目的地，所以这里一直跑着一个读
+// backupQueue 的 worker：它消费到的数据既可能来自首次失败，也可能来自
+// queueScanLoop 的退避重试。
+func (ft *FtSender) sendFromQueue(q queue.BackendQueue) {
+	readChan := q.ReadChan()
 	timer := time.NewTicker(time.Second)
-	waitCnt := 1
-	var curDataContext, otherDataContext []*datasContext
-	var curIdx int
-	var backDataContext []*datasContext
-	var err error
+	defer timer.Stop()
 	for {
 		if atomic.LoadInt32(&ft.stopped) > 0 {
 			ft.exitChan <- struct{}{}
 			return
 		}
-		if curIdx < len(curDataContext) {
-			backDataContext, err = ft.trySendDatas(curDataContext[curIdx].Datas, waitCnt)
-			curIdx++
-		} else {
-			select {
-			case dat := <-readChan:
-				backDataContext, err = ft.trySendBytes(dat, waitCnt)
-			case <-timer.C:
+		select {
+		case dat := <-readChan:
+			datas, err := ft.unmarshalData(dat)
+			if err != nil {
+				log.Errorf("Runner[%v] Sender[%v] cannot unmarshal data from queue %v: %v", ft.runnerName, ft.innerSender.Name(), q.Name(), err)
 				continue
 			}
+			ft.dispatch(&retryableMessage{id: ft.nextMessageID(), ctx: &datasContext{Datas: datas}, fromQueue: q})
+		case <-timer.C:
+			continue
 		}
-		if err == nil {
-			waitCnt = 1
-			ft.se.AddSuccess()
-		} else {
-			log.Errorf("Runner[%v] Sender[%v] cannot send points from queue %v, error is %v", ft.runnerName, ft.innerSender.Name(), queue.Name(), err)
+	}
+}
+
+// persistForRetry 把退避到期、需要重新投递的消息重新落盘到 backupQueue，再由
+// sendFromQueue(ft.backupQueue) 这个一直在跑的 worker 读出来发送。之前的实现
+// 只是把消息直接丢进内存里的 resendChan，进程在发出这次重试请求之前崩溃就会
+// 彻底丢失这条消息；现在一旦退避结束，消息立刻有了磁盘上的副本。
+func (ft *FtSender) persistForRetry(m *retryableMessage) {
+	bs, err := ft.marshalData(m.ctx.Datas)
+	if err != nil {
+		log.Errorf("Runner[%v] Sender[%v] failed to marshal message %v for retry, dropping it: %v", ft.runnerName, ft.innerSender.Name(), m.id, err)
+		return
+	}
+	if err = ft.backupQueue.Put(bs); err != nil {
+		log.Errorf("Runner[%v] Sender[%v] failed to persist message %v to backupQueue before retry: %v", ft.runnerName, ft.innerSender.Name(), m.id, err)
+	}
+}
+
+// dispatch 发送一条消息：注册 in-flight、调用 innerSender.Send、ack 或 requeue。
+//
+// scheduler.Dispatch 是同步调用，一次耗时超过 defaultVisibilityTimeout 的发送
+// （长尾请求本身就是 Scheduler 对冲要处理的场景）会被 queueScanLoop 误判成
+// worker 已经崩溃而重新投递一份，这次 dispatch 实际上还在正常发送。ack 返回
+// ok=false 就是这种情况发生过的信号：说明这条消息已经被别处重新投递，这里不
+// 再二次 requeue 去放大重复，只记录日志，但仍然如实统计这次真实发生过的
+// 成功/失败。
+func (ft *FtSender) dispatch(m *retryableMessage) {
+	ft.inFlight.add(&inFlightMessage{retryableMessage: m, visibleAt: time.Now().Add(defaultVisibilityTimeout)})
+	err := ft.scheduler.Dispatch(context.Background(), ft.innerSender, m.ctx.Datas)
+	if c, ok := err.(*utils.StatsError); ok {
+		err = c.ErrorDetail
+	}
+	_, stillInFlight := ft.inFlight.ack(m.id)
+	if !stillInFlight {
+		if err != nil {
+			log.Warnf("Runner[%v] Sender[%v] message %v was already expired and requeued by queueScanLoop while this send was still running (likely produced a duplicate downstream), not requeueing it a second time: %v", ft.runnerName, ft.innerSender.Name(), m.id, err)
 			ft.se.AddErrors()
-			waitCnt++
-			if waitCnt > 10 {
-				waitCnt = 10
-			}
-		}
-		if backDataContext != nil {
-			otherDataContext = append(otherDataContext, backDataContext...)
-		}
-		if curIdx == len(curDataContext) {
-			curDataContext = otherDataContext
-			otherDataContext = make([]*datasContext, 0)
-			curIdx = 0
+			return
 		}
+		ft.se.AddSuccess()
+		return
+	}
+	if err == nil {
+		ft.se.AddSuccess()
+		return
+	}
+	log.Errorf("Runner[%v] Sender[%v] cannot send points from queue %v, error is %v", ft.runnerName, ft.innerSender.Name(), m.fromQueue.Name(), err)
+	ft.se.AddErrors()
+	for _, v := range ft.handleSendError(err, m.ctx.Datas) {
+		ft.requeue(&retryableMessage{id: ft.nextMessageID(), ctx: v, fromQueue: m.fromQueue, attempt: m.attempt})
 	}
 }
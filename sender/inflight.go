@@ -0,0 +1,297 @@
+package sender
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qiniu/log"
+	"github.com/qiniu/logkit/queue"
+)
+
+const (
+	// defaultVisibilityTimeout 消息被取出但未 ack 的最长时间，超时后会被当做
+	// 丢失重新投递，模拟消费者崩溃场景
+	defaultVisibilityTimeout = 60 * time.Second
+	// queueScanInterval queueScanLoop 的运行间隔
+	queueScanInterval = time.Second
+	// queueScanSelectionCount 每次扫描时从 in-flight / deferred 堆顶按到期时间顺序
+	// 最多处理的消息数，避免集合很大时每秒全量遍历；不做随机抽样，超出的到期
+	// 消息留到下一轮扫描
+	queueScanSelectionCount = 20
+	// defaultBackoffBase 指数退避的基准时长
+	defaultBackoffBase = time.Second
+	// defaultBackoffMax 指数退避的上限
+	defaultBackoffMax = time.Minute * 2
+)
+
+// messageID 是一条 in-flight / deferred 消息的唯一标识，单调递增
+type messageID uint64
+
+// retryableMessage 封装一条等待发送或重试的数据，以及它原本来自哪个 BackendQueue，
+// ack/dead-letter 时需要知道是 logQueue 还是 backupQueue
+type retryableMessage struct {
+	id        messageID
+	ctx       *datasContext
+	fromQueue queue.BackendQueue
+	attempt   int
+}
+
+// inFlightMessage 是已经下发给 sendFromQueue worker、尚未 ack 的消息
+type inFlightMessage struct {
+	*retryableMessage
+	visibleAt time.Time
+	index     int
+}
+
+// deferredMessage 是发送失败、正在等待 backoff 到期后重新投递的消息
+type deferredMessage struct {
+	*retryableMessage
+	notBefore time.Time
+	index     int
+}
+
+type inFlightPqueue []*inFlightMessage
+
+func (pq inFlightPqueue) Len() int { return len(pq) }
+func (pq inFlightPqueue) Less(i, j int) bool {
+	return pq[i].visibleAt.Before(pq[j].visibleAt)
+}
+func (pq inFlightPqueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
+func (pq *inFlightPqueue) Push(x interface{}) {
+	n := len(*pq)
+	m := x.(*inFlightMessage)
+	m.index = n
+	*pq = append(*pq, m)
+}
+func (pq *inFlightPqueue) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	m := old[n-1]
+	m.index = -1
+	*pq = old[:n-1]
+	return m
+}
+
+type deferredPqueue []*deferredMessage
+
+func (pq deferredPqueue) Len() int { return len(pq) }
+func (pq deferredPqueue) Less(i, j int) bool {
+	return pq[i].notBefore.Before(pq[j].notBefore)
+}
+func (pq deferredPqueue) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+	pq[i].index = i
+	pq[j].index = j
+}
+func (pq *deferredPqueue) Push(x interface{}) {
+	n := len(*pq)
+	m := x.(*deferredMessage)
+	m.index = n
+	*pq = append(*pq, m)
+}
+func (pq *deferredPqueue) Pop() interface{} {
+	old := *pq
+	n := len(old)
+	m := old[n-1]
+	m.index = -1
+	*pq = old[:n-1]
+	return m
+}
+
+// inFlightTracker 记录已经下发给 worker 但还没有被 ack 的消息，并维护一个按
+// 可见性超时排序的堆，queueScanLoop 只需要看堆顶就能判断是否有消息超时
+type inFlightTracker struct {
+	sync.Mutex
+	messages map[messageID]*inFlightMessage
+	pq       inFlightPqueue
+}
+
+func newInFlightTracker() *inFlightTracker {
+	return &inFlightTracker{
+		messages: make(map[messageID]*inFlightMessage),
+	}
+}
+
+func (t *inFlightTracker) add(m *inFlightMessage) {
+	t.Lock()
+	t.messages[m.id] = m
+	heap.Push(&t.pq, m)
+	t.Unlock()
+}
+
+// ack 在一次发送返回后（无论成功与否）从 in-flight 集合中移除消息；返回
+// false 表示该消息已经不在集合中（例如已被 queueScanLoop 超时取走）
+func (t *inFlightTracker) ack(id messageID) (*inFlightMessage, bool) {
+	t.Lock()
+	m, ok := t.messages[id]
+	if ok {
+		delete(t.messages, id)
+		if m.index >= 0 {
+			heap.Remove(&t.pq, m.index)
+		}
+	}
+	t.Unlock()
+	return m, ok
+}
+
+func (t *inFlightTracker) depth() int64 {
+	t.Lock()
+	n := len(t.messages)
+	t.Unlock()
+	return int64(n)
+}
+
+// expireTimedOut 取出所有可见性超时的消息，从 in-flight 集合中移除，
+// 调用方负责把它们重新投递（放入 deferred 堆）
+func (t *inFlightTracker) expireTimedOut(now time.Time, limit int) []*inFlightMessage {
+	var expired []*inFlightMessage
+	t.Lock()
+	for i := 0; i < limit && t.pq.Len() > 0; i++ {
+		m := t.pq[0]
+		if m.visibleAt.After(now) {
+			break
+		}
+		heap.Pop(&t.pq)
+		delete(t.messages, m.id)
+		expired = append(expired, m)
+	}
+	t.Unlock()
+	return expired
+}
+
+// deferredTracker 维护等待 backoff 到期后重新投递的消息堆
+type deferredTracker struct {
+	sync.Mutex
+	pq deferredPqueue
+}
+
+func newDeferredTracker() *deferredTracker {
+	return &deferredTracker{}
+}
+
+func (t *deferredTracker) add(m *deferredMessage) {
+	t.Lock()
+	heap.Push(&t.pq, m)
+	t.Unlock()
+}
+
+func (t *deferredTracker) depth() int64 {
+	t.Lock()
+	n := t.pq.Len()
+	t.Unlock()
+	return int64(n)
+}
+
+// popDue 取出所有已经到期可以重新投递的消息
+func (t *deferredTracker) popDue(now time.Time, limit int) []*deferredMessage {
+	var due []*deferredMessage
+	t.Lock()
+	for i := 0; i < limit && t.pq.Len() > 0; i++ {
+		m := t.pq[0]
+		if m.notBefore.After(now) {
+			break
+		}
+		heap.Pop(&t.pq)
+		due = append(due, m)
+	}
+	t.Unlock()
+	return due
+}
+
+// backoffDuration 计算指数退避时长并加入随机抖动，避免大批量消息在同一时刻
+// 集中重试造成惊群
+func backoffDuration(attempt int) time.Duration {
+	d := defaultBackoffBase << uint(attempt)
+	if d <= 0 || d > defaultBackoffMax {
+		d = defaultBackoffMax
+	}
+	jitter := time.Duration(rand.Int63n(int64(d) / 2))
+	return d + jitter
+}
+
+// nextMessageID 分配一个单调递增的消息 ID
+func (ft *FtSender) nextMessageID() messageID {
+	return messageID(atomic.AddUint64(&ft.msgIDSeq, 1))
+}
+
+// Ftlag 统计磁盘队列积压、in-flight 以及 deferred 中的消息数量之和，
+// 这样运维看到的 lag 才是真正未完成的消息总量
+func (ft *FtSender) ftlag() int64 {
+	lag := ft.logQueue.Depth() + ft.backupQueue.Depth()
+	lag += ft.inFlight.depth() + ft.deferred.depth()
+	return lag
+}
+
+// deadletter 把超过 KeyFtMaxAttempts 次重试仍然失败的消息写入独立的 deadletter
+// 磁盘队列，而不是无限重试下去
+func (ft *FtSender) deadletter(m *retryableMessage) {
+	if ft.deadletterQueue == nil {
+		log.Errorf("Runner[%v] Sender[%v] message %v exceeded max attempts %v and no deadletter queue configured, dropping",
+			ft.runnerName, ft.innerSender.Name(), m.id, ft.maxAttempts)
+		return
+	}
+	bs, err := ft.marshalData(m.ctx.Datas)
+	if err != nil {
+		log.Errorf("Runner[%v] Sender[%v] failed to marshal deadletter message %v: %v", ft.runnerName, ft.innerSender.Name(), m.id, err)
+		return
+	}
+	if err = ft.deadletterQueue.Put(bs); err != nil {
+		log.Errorf("Runner[%v] Sender[%v] failed to write message %v to deadletter queue: %v", ft.runnerName, ft.innerSender.Name(), m.id, err)
+		return
+	}
+	log.Warnf("Runner[%v] Sender[%v] message %v exceeded max attempts %v, moved to deadletter queue", ft.runnerName, ft.innerSender.Name(), m.id, ft.maxAttempts)
+}
+
+// requeue 处理一次发送失败：如果已经超过最大重试次数则进入 deadletter，
+// 否则按指数退避计算 notBefore 并放入 deferred 堆等待下一轮投递。
+//
+// deferred 堆本身只活在内存里，只负责退避计时；真正承载数据持久性的是
+// queueScanLoop 在退避到期时把消息重新落盘到 backupQueue（见该函数），消息
+// 从落盘那一刻起才有了能扛过进程崩溃的副本。等待退避的这段时间（最长
+// defaultBackoffMax）消息仍然只在内存中，这是本设计有意接受的一个有上限的
+// at-most-once 窗口。
+func (ft *FtSender) requeue(m *retryableMessage) {
+	m.attempt++
+	if ft.maxAttempts > 0 && m.attempt > ft.maxAttempts {
+		ft.deadletter(m)
+		return
+	}
+	ft.deferred.add(&deferredMessage{
+		retryableMessage: m,
+		notBefore:        time.Now().Add(backoffDuration(m.attempt)),
+	})
+}
+
+// queueScanLoop 每秒运行一次，从堆顶检查 in-flight 中是否有可见性超时的消息
+// （需要重新投递）以及 deferred 堆中是否有到期可以重发的消息，每个堆每轮最多
+// 处理 queueScanSelectionCount 条，避免每秒全量遍历所有消息
+func (ft *FtSender) queueScanLoop() {
+	ticker := time.NewTicker(queueScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if atomic.LoadInt32(&ft.stopped) > 0 {
+				continue
+			}
+			now := time.Now()
+			for _, m := range ft.inFlight.expireTimedOut(now, queueScanSelectionCount) {
+				log.Warnf("Runner[%v] Sender[%v] message %v visibility timeout, requeueing", ft.runnerName, ft.innerSender.Name(), m.id)
+				ft.requeue(m.retryableMessage)
+			}
+			for _, m := range ft.deferred.popDue(now, queueScanSelectionCount) {
+				ft.persistForRetry(m.retryableMessage)
+			}
+		case <-ft.scanExitChan:
+			ft.exitChan <- struct{}{}
+			return
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package sender
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qiniu/log"
+)
+
+// 可选参数，用于配置 Scheduler
+const (
+	KeyFtMaxConcurrent        = "ft_max_concurrent"         // 一个 runner 内所有 FtSender 共享的最大并发发送数
+	KeyFtLongTailMarginMs     = "ft_long_tail_margin_ms"    // 对冲请求的最小等待时间，单位毫秒
+	KeyFtHedgeAfterPercentile = "ft_hedge_after_percentile" // 超过最近成功请求该分位数的耗时后触发对冲，取值 0~1
+)
+
+const (
+	defaultMaxConcurrent        = 0 // 0 表示不限制并发
+	defaultLongTailMarginMs     = 0 // 0 表示不开启长尾对冲
+	defaultHedgeAfterPercentile = 0.95
+	latencySampleSize           = 128 // 用于估算分位数的最近请求耗时样本数
+)
+
+// CtxSender 是 Sender 的可选扩展接口。实现了 SendCtx 的 innerSender 才能参与
+// Scheduler 的长尾对冲：对冲发起的第二次尝试通过 ctx 取消，避免对冲胜出后
+// 另一个请求仍然占用下游资源。
+//
+// ft_long_tail_margin_ms 对没有实现这个接口的 sender 完全是个no-op ——
+// Dispatch 会 type-assert 失败并直接退化成普通的 Send，newFtSender 会在这种
+// 情况下打一条 warning 日志，避免配置了这个参数却不起作用的情况被悄悄吞掉。
+type CtxSender interface {
+	SendCtx(ctx context.Context, datas []Data) error
+}
+
+// Scheduler 用一个按 runner 共享的信号量，使同一个 runner 下所有 FtSender 的
+// innerSender.Send 调用共享同一个并发上限。每个 FtSender 仍然按 ft_procs 启动
+// 固定数量的 sendFromQueue goroutine，信号量限制的是这些 goroutine 同时进行中
+// 的发送数，并不取代 ft_procs。当一次发送的耗时超过最近成功请求的 p95（长尾）时，Scheduler 会在
+// 信号量允许的情况下向第二个 worker 派发一次相同数据的重复请求，取先返回的结果，
+// 这借鉴了 uplink 的 maximum-concurrent-pieces / long-tail-margin 设计，用于
+// 缓解下游（例如 Pandora HTTP）偶发慢请求拖慢整个 sendFromQueue worker 的问题。
+type Scheduler struct {
+	sem chan struct{}
+
+	maxConcurrent   int // 仅用于 getOrCreateScheduler 检测后来者的配置分歧，不参与调度逻辑
+	longTailMargin  time.Duration
+	hedgePercentile float64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	latIdx    int
+}
+
+// NewScheduler 构造一个 Scheduler。maxConcurrent <= 0 表示不限制并发；
+// longTailMargin <= 0 表示不开启长尾对冲。
+func NewScheduler(maxConcurrent int, longTailMargin time.Duration, hedgePercentile float64) *Scheduler {
+	if hedgePercentile <= 0 || hedgePercentile >= 1 {
+		hedgePercentile = defaultHedgeAfterPercentile
+	}
+	var sem chan struct{}
+	if maxConcurrent > 0 {
+		sem = make(chan struct{}, maxConcurrent)
+	}
+	return &Scheduler{
+		sem:             sem,
+		maxConcurrent:   maxConcurrent,
+		longTailMargin:  longTailMargin,
+		hedgePercentile: hedgePercentile,
+		latencies:       make([]time.Duration, 0, latencySampleSize),
+	}
+}
+
+func (s *Scheduler) acquire() {
+	if s.sem != nil {
+		s.sem <- struct{}{}
+	}
+}
+
+func (s *Scheduler) release() {
+	if s.sem != nil {
+		<-s.sem
+	}
+}
+
+// tryAcquire 非阻塞地尝试占用一个并发名额，用于对冲请求：如果此时已经没有
+// 剩余并发名额，就不发起对冲，直接等待第一个请求返回。
+func (s *Scheduler) tryAcquire() bool {
+	if s.sem == nil {
+		return true
+	}
+	select {
+	case s.sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// recordLatency 只记录成功请求的耗时，失败请求不参与分位数估算
+func (s *Scheduler) recordLatency(d time.Duration, err error) {
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	if len(s.latencies) < latencySampleSize {
+		s.latencies = append(s.latencies, d)
+	} else {
+		s.latencies[s.latIdx] = d
+		s.latIdx = (s.latIdx + 1) % latencySampleSize
+	}
+	s.mu.Unlock()
+}
+
+// hedgeThreshold 返回触发对冲的耗时阈值，即最近成功请求耗时样本的 p95（或配置的
+// 分位数），且不低于 longTailMargin。还没有任何样本时退化为 longTailMargin 本身，
+// 避免冷启动时误触发对冲。
+func (s *Scheduler) hedgeThreshold() time.Duration {
+	s.mu.Lock()
+	n := len(s.latencies)
+	if n == 0 {
+		s.mu.Unlock()
+		return s.longTailMargin
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, s.latencies)
+	s.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(float64(n) * s.hedgePercentile)
+	if idx >= n {
+		idx = n - 1
+	}
+	threshold := sorted[idx]
+	if threshold < s.longTailMargin {
+		threshold = s.longTailMargin
+	}
+	return threshold
+}
+
+// Dispatch 在 Scheduler 的并发限制下发送一次数据。sender 实现了 CtxSender 且
+// longTailMargin > 0 时才会参与长尾对冲，否则直接退化为普通的 Send 调用。
+func (s *Scheduler) Dispatch(ctx context.Context, sender Sender, datas []Data) error {
+	s.acquire()
+	defer s.release()
+
+	cs, hedgeable := sender.(CtxSender)
+	if !hedgeable || s.longTailMargin <= 0 {
+		start := time.Now()
+		err := sender.Send(datas)
+		s.recordLatency(time.Since(start), err)
+		return err
+	}
+
+	hedgeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	resultChan := make(chan error, 2)
+	go func() {
+		resultChan <- cs.SendCtx(hedgeCtx, datas)
+	}()
+
+	timer := time.NewTimer(s.hedgeThreshold())
+	defer timer.Stop()
+
+	select {
+	case err := <-resultChan:
+		s.recordLatency(time.Since(start), err)
+		return err
+	case <-timer.C:
+	}
+
+	if !s.tryAcquire() {
+		// 没有空闲并发名额，放弃对冲，继续等待第一次请求的结果
+		err := <-resultChan
+		s.recordLatency(time.Since(start), err)
+		return err
+	}
+
+	log.Infof("Sender[%v] send exceeded p%.0f latency, dispatching hedged attempt", sender.Name(), s.hedgePercentile*100)
+	go func() {
+		defer s.release()
+		resultChan <- cs.SendCtx(hedgeCtx, datas)
+	}()
+
+	err := <-resultChan
+	cancel() // 取消尚未返回的另一个请求（无论它是原始请求还是对冲请求）
+	s.recordLatency(time.Since(start), err)
+	return err
+}
+
+// schedulerRegistry 保存每个 runner 的 Scheduler 实例，使同一个 runner 内的多个
+// FtSender（不同的 sender 配置多个输出）共享同一个并发上限，而不是各自独立限流。
+var (
+	schedulerRegistryMu sync.Mutex
+	schedulerRegistry   = make(map[string]*Scheduler)
+)
+
+// getOrCreateScheduler 返回 runnerName 对应的共享 Scheduler，不存在则创建。一个
+// runner 内的多个 FtSender（多个输出）共享同一个 Scheduler，所以只有第一个
+// FtSender 的 maxConcurrent/longTailMargin/hedgePercentile 真正生效；如果后面
+// 创建的 FtSender 传入了不同的值，那些值会被静默忽略，这里打一条日志让这种
+// 配置分歧在日志里可见，而不是被吞掉。
+func getOrCreateScheduler(runnerName string, maxConcurrent int, longTailMargin time.Duration, hedgePercentile float64) *Scheduler {
+	schedulerRegistryMu.Lock()
+	defer schedulerRegistryMu.Unlock()
+	if s, ok := schedulerRegistry[runnerName]; ok {
+		if s.maxConcurrent != maxConcurrent || s.longTailMargin != longTailMargin || s.hedgePercentile != hedgePercentile {
+			log.Warnf("Runner[%v]: scheduler already created with maxConcurrent=%v longTailMargin=%v hedgePercentile=%v, ignoring different config (maxConcurrent=%v longTailMargin=%v hedgePercentile=%v) requested by a later Sender in the same runner",
+				runnerName, s.maxConcurrent, s.longTailMargin, s.hedgePercentile, maxConcurrent, longTailMargin, hedgePercentile)
+		}
+		return s
+	}
+	s := NewScheduler(maxConcurrent, longTailMargin, hedgePercentile)
+	schedulerRegistry[runnerName] = s
+	return s
+}
@@ -0,0 +1,79 @@
+package sender
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hedgeTestSender 是一个只在测试里使用的 Sender+CtxSender：第一次调用模拟一个
+// 远慢于正常水平的长尾请求，第二次调用（即 Scheduler 发起的对冲请求）很快返回，
+// 用来验证 Dispatch 真的会在超过阈值后发起对冲并采用先返回的结果。
+type hedgeTestSender struct {
+	calls int32
+}
+
+func (s *hedgeTestSender) Name() string { return "hedgeTestSender" }
+
+func (s *hedgeTestSender) Send(datas []Data) error {
+	return s.SendCtx(context.Background(), datas)
+}
+
+func (s *hedgeTestSender) SendCtx(ctx context.Context, datas []Data) error {
+	if atomic.AddInt32(&s.calls, 1) == 1 {
+		select {
+		case <-time.After(300 * time.Millisecond):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+func (s *hedgeTestSender) Close() error { return nil }
+
+func TestSchedulerDispatchHedgesLongTailRequest(t *testing.T) {
+	s := NewScheduler(2, 20*time.Millisecond, 0.5)
+	sender := &hedgeTestSender{}
+
+	start := time.Now()
+	if err := s.Dispatch(context.Background(), sender, nil); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if calls := atomic.LoadInt32(&sender.calls); calls != 2 {
+		t.Fatalf("sender.calls = %d, want 2 (original + hedged attempt)", calls)
+	}
+	if elapsed >= 150*time.Millisecond {
+		t.Fatalf("Dispatch took %v, want it to return with the hedged attempt's result well before the 300ms original request finishes", elapsed)
+	}
+}
+
+// plainTestSender 不实现 CtxSender，用来验证 Dispatch 在 sender 不支持
+// SendCtx 时会直接退化为普通的 Send 调用，不会尝试对冲
+type plainTestSender struct {
+	calls int32
+}
+
+func (s *plainTestSender) Name() string { return "plainTestSender" }
+func (s *plainTestSender) Send(datas []Data) error {
+	atomic.AddInt32(&s.calls, 1)
+	return nil
+}
+func (s *plainTestSender) Close() error { return nil }
+
+func TestSchedulerDispatchWithoutHedging(t *testing.T) {
+	s := NewScheduler(1, 20*time.Millisecond, 0.5)
+	sender := &plainTestSender{}
+
+	if err := s.Dispatch(context.Background(), sender, nil); err != nil {
+		t.Fatalf("Dispatch: %v", err)
+	}
+	if calls := atomic.LoadInt32(&sender.calls); calls != 1 {
+		t.Fatalf("sender.calls = %d, want 1 (no hedging for a non-CtxSender)", calls)
+	}
+}